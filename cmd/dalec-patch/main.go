@@ -0,0 +1,63 @@
+// Command dalec-patch applies a single patch file to a directory tree using
+// dalecpatch, the native Go patch engine the RPM frontend drives instead of
+// shelling out to GNU patch. This binary is what PatchImageRef's image runs.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Azure/dalec/frontend/rpm/dalecpatch"
+)
+
+type excludeFlags []string
+
+func (e *excludeFlags) String() string { return strings.Join(*e, ",") }
+
+func (e *excludeFlags) Set(v string) error {
+	*e = append(*e, v)
+	return nil
+}
+
+func main() {
+	var (
+		strip   int
+		format  string
+		src     string
+		patch   string
+		reverse bool
+		exclude excludeFlags
+	)
+
+	flag.IntVar(&strip, "strip", 1, "number of leading path components to strip, like patch -p")
+	flag.StringVar(&format, "format", "unified", "patch format: unified or git; context is rejected")
+	flag.StringVar(&src, "src", "", "directory to apply the patch to")
+	flag.StringVar(&patch, "patch", "", "path to the patch file")
+	flag.BoolVar(&reverse, "reverse", false, "apply the patch in reverse")
+	flag.Var(&exclude, "exclude", "path to exclude from the patch; may be repeated")
+	flag.Parse()
+
+	if src == "" || patch == "" {
+		fmt.Fprintln(os.Stderr, "dalec-patch: --src and --patch are required")
+		os.Exit(2)
+	}
+
+	dt, err := os.ReadFile(patch)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dalec-patch: %v\n", err)
+		os.Exit(1)
+	}
+
+	err = dalecpatch.Apply(src, dt, dalecpatch.Options{
+		Strip:        strip,
+		Reverse:      reverse,
+		Format:       format,
+		ExcludePaths: exclude,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dalec-patch: %v\n", err)
+		os.Exit(1)
+	}
+}
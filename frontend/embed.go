@@ -0,0 +1,43 @@
+package frontend
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/moby/buildkit/client"
+	gwclient "github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/moby/buildkit/frontend/gateway/grpcclient"
+)
+
+// BuildFunc is the signature Dalec's target handlers are driven through,
+// matching gwclient.BuildFunc. It's aliased here so callers of Serve and
+// RunEmbedded don't need to import the gateway client package themselves.
+type BuildFunc = gwclient.BuildFunc
+
+// Serve runs f as an embedded buildkit gateway, the same way a frontend
+// image invoked as `gateway.v0` would be run, except in-process. This lets
+// Dalec's own binary double as its frontend: `dalec build --frontend
+// embedded` can drive a build without ever publishing or pulling a
+// `dalec` frontend image, which matters for buildkitd versions that
+// predate the 0.12 `input:` context syntax and for air-gapped registries
+// that can't pull one at all.
+func Serve(ctx context.Context, f BuildFunc) error {
+	if err := grpcclient.RunFromEnvironment(ctx, f); err != nil {
+		return fmt.Errorf("error running embedded dalec frontend: %w", err)
+	}
+	return nil
+}
+
+// RunEmbedded drives f, a target handler already bound to whatever spec it
+// builds, directly against an already-connected buildkit client, skipping
+// the `gateway.v0` frontend indirection entirely. It's the low-level
+// counterpart to Serve: where Serve lets buildkitd invoke Dalec as a
+// gateway, RunEmbedded lets a caller that already has a *client.Client (e.g.
+// a vendored buildkit import, or `docker buildx build` with the containerd
+// image store disabled) invoke Dalec's target handlers as an ordinary
+// solve.
+func RunEmbedded(ctx context.Context, c *client.Client, f BuildFunc, solveOpt client.SolveOpt) (*client.SolveResponse, error) {
+	return c.Build(ctx, solveOpt, "", func(ctx context.Context, gwc gwclient.Client) (*gwclient.Result, error) {
+		return f(ctx, gwc)
+	}, nil)
+}
@@ -0,0 +1,115 @@
+package rpm
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Azure/dalec"
+	"github.com/moby/buildkit/client/llb"
+)
+
+func TestSourceCacheKeyStable(t *testing.T) {
+	ctx := context.Background()
+	st := llb.Scratch().File(llb.Mkfile("hello.txt", 0o644, []byte("hello")))
+
+	k1, err := sourceCacheKey(ctx, st, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k2, err := sourceCacheKey(ctx, st, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k1 != k2 {
+		t.Fatalf("expected stable cache key, got %q and %q", k1, k2)
+	}
+
+	other := llb.Scratch().File(llb.Mkfile("hello.txt", 0o644, []byte("different")))
+	k3, err := sourceCacheKey(ctx, other, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k3 == k1 {
+		t.Fatal("expected different content to produce a different cache key")
+	}
+}
+
+// TestSourceCacheKeyStableAcrossTarImageRef checks that overriding
+// TarImageRef doesn't change a source's cache key: the key is derived from
+// the pre-tar source state, before tar()'s image choice enters the graph,
+// so switching which image produces the tarball shouldn't invalidate every
+// existing cache entry.
+func TestSourceCacheKeyStableAcrossTarImageRef(t *testing.T) {
+	ctx := context.Background()
+	st := llb.Scratch().File(llb.Mkfile("hello.txt", 0o644, []byte("hello")))
+
+	k1, err := sourceCacheKey(ctx, st, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orig := TarImageRef
+	TarImageRef = "example.com/some-other-tar-image:latest"
+	defer func() { TarImageRef = orig }()
+
+	k2, err := sourceCacheKey(ctx, st, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k1 != k2 {
+		t.Fatalf("expected TarImageRef override not to affect the cache key, got %q and %q", k1, k2)
+	}
+}
+
+// TestSourceCacheKeyChangesWithPatchImageRef checks the opposite case:
+// PatchImageRef is baked into the patched source state itself (applyPatch
+// runs llb.Image(PatchImageRef)), so overriding it changes the LLB graph
+// sourceCacheKey hashes, and the resulting tar cache key must change too --
+// otherwise a build could serve a tarball produced by a different patch
+// tool than the one that built it.
+func TestSourceCacheKeyChangesWithPatchImageRef(t *testing.T) {
+	ctx := context.Background()
+	spec := &dalec.Spec{}
+	src := llb.Scratch().File(llb.Mkfile("hello.txt", 0o644, []byte("hello")))
+	patchSrc := llb.Scratch().File(llb.Mkfile("hello.patch", 0o644, []byte("patch")))
+
+	cfg := dalec.PatchSpec{Source: "patch"}
+
+	st1 := applyPatch(spec, "src", cfg, src, patchSrc)
+	k1, err := sourceCacheKey(ctx, st1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orig := PatchImageRef
+	PatchImageRef = "example.com/some-other-patch-image:latest"
+	defer func() { PatchImageRef = orig }()
+
+	st2 := applyPatch(spec, "src", cfg, src, patchSrc)
+	k2, err := sourceCacheKey(ctx, st2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k1 == k2 {
+		t.Fatal("expected PatchImageRef override to change the cache key")
+	}
+}
+
+func TestIsSourceCacheDisabled(t *testing.T) {
+	for _, tc := range []struct {
+		opts map[string]string
+		want bool
+	}{
+		{opts: nil, want: false},
+		{opts: map[string]string{}, want: false},
+		{opts: map[string]string{noSourceCacheOpt: ""}, want: true},
+		{opts: map[string]string{noSourceCacheOpt: "1"}, want: true},
+		{opts: map[string]string{noSourceCacheOpt: "true"}, want: true},
+		{opts: map[string]string{noSourceCacheOpt: "false"}, want: false},
+	} {
+		got := isSourceCacheDisabled(tc.opts)
+		if got != tc.want {
+			t.Errorf("opts=%v: got %v, want %v", tc.opts, got, tc.want)
+		}
+	}
+}
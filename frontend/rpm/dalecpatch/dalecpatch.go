@@ -0,0 +1,196 @@
+// Package dalecpatch applies unified and git-formatted patches (including
+// git binary hunks) directly to a directory tree, without shelling out to
+// GNU patch. It backs the native patch step used by the RPM frontend so
+// that patch application can run as a small, cache-friendly buildkit step
+// instead of a container that merely wraps `patch -p1`. Old-style context
+// diffs are not supported; Apply rejects Options.Format == "context"
+// rather than silently misparsing one as unified.
+package dalecpatch
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bluekeyes/go-gitdiff/gitdiff"
+)
+
+// Options controls how a single patch file is applied to a source tree.
+type Options struct {
+	// Strip is the number of leading path components to remove from each
+	// file path named in the patch, equivalent to `patch -p<Strip>`.
+	Strip int
+	// Reverse applies the patch in reverse, i.e. undoes it.
+	Reverse bool
+	// Format is the patch format: "unified" (the default, also accepted as
+	// ""), or "git". "context" is rejected: gitdiff.Parse has no support
+	// for old-style context diffs, so rather than misparse or silently
+	// fall back to unified, Apply errors out.
+	Format string
+	// ExcludePaths are file paths (after stripping) that are skipped even
+	// if the patch touches them.
+	ExcludePaths []string
+}
+
+// Apply parses patchData (unified or git format, including binary hunks)
+// and applies every file in it under dir.
+func Apply(dir string, patchData []byte, opt Options) error {
+	if opt.Format == "context" {
+		return fmt.Errorf("dalecpatch: context diffs are not supported")
+	}
+
+	files, _, err := gitdiff.Parse(bytes.NewReader(patchData))
+	if err != nil {
+		return fmt.Errorf("parsing patch: %w", err)
+	}
+
+	for _, f := range files {
+		target := f
+		if opt.Reverse {
+			target, err = reverseFile(f)
+			if err != nil {
+				return fmt.Errorf("reversing patch to %s: %w", targetName(f), err)
+			}
+		}
+		if err := applyFile(dir, target, opt); err != nil {
+			return fmt.Errorf("applying patch to %s: %w", targetName(f), err)
+		}
+	}
+
+	return nil
+}
+
+// reverseFile returns the gitdiff.File that undoes f, by swapping its old
+// and new sides: names, modes, new/delete status, and -- for text files --
+// each fragment's position/line counts and the add/delete sense of every
+// line. gitdiff.Apply has no reverse-apply mode of its own, so this is done
+// before calling it rather than by passing a flag through.
+func reverseFile(f *gitdiff.File) (*gitdiff.File, error) {
+	r := &gitdiff.File{
+		OldName:  f.NewName,
+		NewName:  f.OldName,
+		IsNew:    f.IsDelete,
+		IsDelete: f.IsNew,
+		IsCopy:   f.IsCopy,
+		IsRename: f.IsRename,
+		OldMode:  f.NewMode,
+		NewMode:  f.OldMode,
+	}
+
+	if f.IsBinary {
+		if f.ReverseBinaryFragment == nil {
+			return nil, fmt.Errorf("patch has no reverse binary fragment")
+		}
+		r.IsBinary = true
+		r.BinaryFragment = f.ReverseBinaryFragment
+		return r, nil
+	}
+
+	r.TextFragments = make([]*gitdiff.TextFragment, len(f.TextFragments))
+	for i, frag := range f.TextFragments {
+		lines := make([]gitdiff.Line, len(frag.Lines))
+		for j, l := range frag.Lines {
+			switch l.Op {
+			case gitdiff.OpAdd:
+				l.Op = gitdiff.OpDelete
+			case gitdiff.OpDelete:
+				l.Op = gitdiff.OpAdd
+			}
+			lines[j] = l
+		}
+		r.TextFragments[i] = &gitdiff.TextFragment{
+			Comment:         frag.Comment,
+			OldPosition:     frag.NewPosition,
+			OldLines:        frag.NewLines,
+			NewPosition:     frag.OldPosition,
+			NewLines:        frag.OldLines,
+			LinesAdded:      frag.LinesDeleted,
+			LinesDeleted:    frag.LinesAdded,
+			LeadingContext:  frag.LeadingContext,
+			TrailingContext: frag.TrailingContext,
+			Lines:           lines,
+		}
+	}
+
+	return r, nil
+}
+
+func targetName(f *gitdiff.File) string {
+	if f.NewName != "" {
+		return f.NewName
+	}
+	return f.OldName
+}
+
+func strip(name string, n int) string {
+	for ; n > 0; n-- {
+		idx := strings.IndexByte(name, '/')
+		if idx < 0 {
+			return name
+		}
+		name = name[idx+1:]
+	}
+	return name
+}
+
+func isExcluded(name string, excludes []string) bool {
+	for _, ex := range excludes {
+		if name == ex || strings.HasPrefix(name, ex+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func applyFile(dir string, f *gitdiff.File, opt Options) error {
+	isNew, isDelete := f.IsNew, f.IsDelete
+
+	target := strip(targetName(f), opt.Strip)
+	if isExcluded(target, opt.ExcludePaths) {
+		return nil
+	}
+	target = filepath.Join(dir, target)
+
+	if isDelete {
+		return os.Remove(target)
+	}
+
+	var original *os.File
+	if !isNew {
+		fh, err := os.Open(target)
+		if err != nil {
+			return err
+		}
+		defer fh.Close()
+		original = fh
+	}
+
+	var buf bytes.Buffer
+	var src interface {
+		ReadAt(p []byte, off int64) (int, error)
+	}
+	if original != nil {
+		src = original
+	} else {
+		src = bytes.NewReader(nil)
+	}
+
+	if err := gitdiff.Apply(&buf, src, f); err != nil {
+		return fmt.Errorf("apply: %w", err)
+	}
+
+	if isNew {
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return err
+		}
+	}
+
+	mode := os.FileMode(0o644)
+	if f.NewMode != 0 {
+		mode = os.FileMode(f.NewMode)
+	}
+
+	return os.WriteFile(target, buf.Bytes(), mode)
+}
@@ -0,0 +1,231 @@
+package dalecpatch
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeFile(t *testing.T, dir, name, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, dir, name string) string {
+	t.Helper()
+	dt, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(dt)
+}
+
+func TestApplyMultiHunk(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "greeting.txt", "hello\nworld\nfoo\nbar\n")
+
+	patch := []byte(`diff --git a/greeting.txt b/greeting.txt
+index e69de29..4b825dc 100644
+--- a/greeting.txt
++++ b/greeting.txt
+@@ -1,2 +1,2 @@
+-hello
++hi
+ world
+@@ -3,2 +3,2 @@
+ foo
+-bar
++baz
+`)
+
+	if err := Apply(dir, patch, Options{Strip: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := readFile(t, dir, "greeting.txt")
+	want := "hi\nworld\nfoo\nbaz\n"
+	if got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestApplyExcludePaths(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "keep.txt", "a\n")
+	writeFile(t, dir, "skip.txt", "b\n")
+
+	patch := []byte(`diff --git a/keep.txt b/keep.txt
+--- a/keep.txt
++++ b/keep.txt
+@@ -1 +1 @@
+-a
++a2
+diff --git a/skip.txt b/skip.txt
+--- a/skip.txt
++++ b/skip.txt
+@@ -1 +1 @@
+-b
++b2
+`)
+
+	if err := Apply(dir, patch, Options{Strip: 1, ExcludePaths: []string{"skip.txt"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readFile(t, dir, "keep.txt"); got != "a2\n" {
+		t.Fatalf("keep.txt: got %q", got)
+	}
+	if got := readFile(t, dir, "skip.txt"); got != "b\n" {
+		t.Fatalf("skip.txt should be untouched, got %q", got)
+	}
+}
+
+func TestApplyNewFile(t *testing.T) {
+	dir := t.TempDir()
+
+	patch := []byte(`diff --git a/new.txt b/new.txt
+new file mode 100644
+--- /dev/null
++++ b/new.txt
+@@ -0,0 +1 @@
++created
+`)
+
+	if err := Apply(dir, patch, Options{Strip: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readFile(t, dir, "new.txt"); got != "created\n" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestApplyReverse(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "greeting.txt", "hi\nworld\nfoo\nbaz\n")
+
+	patch := []byte(`diff --git a/greeting.txt b/greeting.txt
+index e69de29..4b825dc 100644
+--- a/greeting.txt
++++ b/greeting.txt
+@@ -1,2 +1,2 @@
+-hello
++hi
+ world
+@@ -3,2 +3,2 @@
+ foo
+-bar
++baz
+`)
+
+	if err := Apply(dir, patch, Options{Strip: 1, Reverse: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := readFile(t, dir, "greeting.txt")
+	want := "hello\nworld\nfoo\nbar\n"
+	if got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestApplyReverseNewFile(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "new.txt", "created\n")
+
+	patch := []byte(`diff --git a/new.txt b/new.txt
+new file mode 100644
+--- /dev/null
++++ b/new.txt
+@@ -0,0 +1 @@
++created
+`)
+
+	if err := Apply(dir, patch, Options{Strip: 1, Reverse: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "new.txt")); !os.IsNotExist(err) {
+		t.Fatalf("expected new.txt to be removed by the reversed patch, stat err = %v", err)
+	}
+}
+
+func TestApplyBinaryPatch(t *testing.T) {
+	dir := t.TempDir()
+
+	src, err := os.ReadFile(filepath.Join("testdata", "binary_modify.src"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile(filepath.Join("testdata", "binary_modify.out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	patch, err := os.ReadFile(filepath.Join("testdata", "binary_modify.patch"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeBin(t, dir, "file.bin", src)
+
+	if err := Apply(dir, patch, Options{Strip: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := readBin(t, dir, "file.bin")
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %x, want %x", got, want)
+	}
+
+	// Reversing the same patch should restore the original bytes.
+	if err := Apply(dir, patch, Options{Strip: 1, Reverse: true}); err != nil {
+		t.Fatal(err)
+	}
+	got = readBin(t, dir, "file.bin")
+	if !bytes.Equal(got, src) {
+		t.Fatalf("after reverse: got %x, want %x", got, src)
+	}
+}
+
+func TestApplyContextFormatRejected(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "greeting.txt", "hello\n")
+
+	patch := []byte(`diff --git a/greeting.txt b/greeting.txt
+--- a/greeting.txt
++++ b/greeting.txt
+@@ -1 +1 @@
+-hello
++hi
+`)
+
+	err := Apply(dir, patch, Options{Strip: 1, Format: "context"})
+	if err == nil {
+		t.Fatal("expected an error for Format: \"context\"")
+	}
+}
+
+func writeBin(t *testing.T, dir, name string, content []byte) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name), content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readBin(t *testing.T, dir, name string) []byte {
+	t.Helper()
+	dt, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dt
+}
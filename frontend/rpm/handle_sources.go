@@ -2,153 +2,427 @@ package rpm
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"path/filepath"
+	"strconv"
+	"time"
 
 	"github.com/Azure/dalec"
 	"github.com/Azure/dalec/frontend"
+	"github.com/containerd/containerd/platforms"
 	"github.com/moby/buildkit/client/llb"
-	"github.com/moby/buildkit/exporter/containerimage/image"
+	"github.com/moby/buildkit/exporter/containerimage/exptypes"
 	gwclient "github.com/moby/buildkit/frontend/gateway/client"
 	"github.com/moby/buildkit/identity"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sync/errgroup"
 )
 
-// TarImageRef is the image used to create tarballs of sources
+// noSourceCacheOpt is the frontend option that disables the source tar
+// cache entirely, falling back to the old behavior of re-tarring on every
+// build.
+const noSourceCacheOpt = "no-source-cache"
+
+// sourceDateEpochOpt is the frontend option used to make source tarballs
+// (and, from there, the RPM %changelog) reproducible, mirroring the
+// dockerfile frontend's handling of the same option.
+const sourceDateEpochOpt = "source-date-epoch"
+
+// defaultSourceCacheID is used for the persistent cache mount when
+// dalec.SourceOpts.SourceCacheID is unset.
+const defaultSourceCacheID = "dalec-source-cache"
+
+// fetchSimulatedLatency, when non-zero, is slept at the start of each
+// source's fetch stage in Dalec2SourcesLLB. It's zero (a no-op) everywhere
+// except BenchmarkSourcePipelineFanOut, which sets it to stand in for the
+// real network/registry latency Source2LLBGetter's pure, in-memory LLB
+// construction has none of, so the benchmark's sequential/concurrent cases
+// have an actual wall-clock difference to show.
+var fetchSimulatedLatency time.Duration
+
+// changelogDateMetaKey is the result metadata key HandleSources publishes the
+// resolved %changelog timestamp under, alongside exptypes.ExporterPlatformsKey,
+// so that whatever renders the RPM spec's %changelog section picks up the
+// same source-date-epoch-derived date the source tarballs were built with.
+const changelogDateMetaKey = "dalec.rpm/changelog-date"
+
+// TarImageRef is the image used to create tarballs of sources when
+// reproducibility isn't requested.
 // This is purposefully exported so it can be overridden at compile time if needed.
 // Currently this image needs /bin/sh and tar in $PATH
 var TarImageRef = "busybox:latest"
-var PatchImageRef = "busybox:latest"
+
+// ReproducibleTarImageRef is used instead of TarImageRef whenever a
+// source-date-epoch is set, since producing a byte-for-byte reproducible
+// tarball needs GNU tar's --sort, --mtime, --owner, and --numeric-owner
+// flags, which busybox tar doesn't support.
+var ReproducibleTarImageRef = "docker.io/library/debian:bookworm-slim"
 
 func shArgs(cmd string) llb.RunOption {
 	return llb.Args([]string{"sh", "-c", cmd})
 }
 
-func tar(src llb.State, dest string, opts ...llb.ConstraintsOpt) llb.State {
-	tarImg := llb.Image(TarImageRef)
+// sourceCacheKey returns a content-addressed key for src, so that the tar
+// step below can tell whether it has already tarred this exact source
+// definition, independent of `dest` or the tar image's digest. epoch is
+// mixed in too, since a source-date-epoch changes the bytes of the
+// resulting tarball even though the source itself didn't change.
+func sourceCacheKey(ctx context.Context, src llb.State, epoch *int64, opts ...llb.ConstraintsOpt) (string, error) {
+	def, err := src.Marshal(ctx, opts...)
+	if err != nil {
+		return "", fmt.Errorf("error marshalling source for cache key: %w", err)
+	}
+
+	h := sha256.New()
+	for _, dt := range def.Def {
+		h.Write(dt)
+	}
+	if epoch != nil {
+		fmt.Fprintf(h, "source-date-epoch=%d", *epoch)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// tarCmd returns the GNU-tar-on-busybox-tar command used to produce dest,
+// and the image that needs to run it. When epoch is set, the tarball is
+// made byte-for-byte reproducible: entries are emitted in sorted name
+// order, with zeroed ownership and mtimes pinned to epoch, which requires
+// real GNU tar rather than whatever minimal tar ships in TarImageRef.
+func tarCmd(dest string, epoch *int64) (string, string) {
+	if epoch == nil {
+		return fmt.Sprintf("tar -C /src -cvzf %s .", dest), TarImageRef
+	}
+	cmd := fmt.Sprintf(
+		"tar -C /src --sort=name --owner=0 --group=0 --numeric-owner --mtime=@%d -cvzf %s .",
+		*epoch, dest,
+	)
+	return cmd, ReproducibleTarImageRef
+}
 
+// tar packs src into a .tar.gz named dest. When caching is enabled (the
+// common case), the tarball is written to and read back from a persistent
+// cache mount keyed by cacheMountID, addressed by sourceCacheKey(src), so
+// that an unchanged source is never re-tarred just because `dest` or the
+// tar image's digest changed.
+func tar(ctx context.Context, src llb.State, dest, cacheMountID string, noCache bool, epoch *int64, opts ...llb.ConstraintsOpt) (llb.State, error) {
 	// Put the output tar in a consistent location regardless of `dest`
 	// This way if `dest` changes we don't have to rebuild the tarball, which can be expensive.
 	outBase := "/tmp/out"
 	out := filepath.Join(outBase, filepath.Dir(dest))
-	worker := tarImg.Run(
+	outFile := filepath.Join(out, filepath.Base(dest))
+
+	if noCache {
+		cmd, imgRef := tarCmd("/tmp/st", epoch)
+		worker := llb.Image(imgRef).Run(
+			llb.AddMount("/src", src, llb.Readonly),
+			shArgs(cmd),
+			dalec.WithConstraints(opts...),
+		).
+			Run(
+				shArgs("mkdir -p "+out+" && mv /tmp/st "+outFile),
+				dalec.WithConstraints(opts...),
+			)
+
+		return worker.AddMount(outBase, llb.Scratch()), nil
+	}
+
+	key, err := sourceCacheKey(ctx, src, epoch, opts...)
+	if err != nil {
+		return llb.State{}, err
+	}
+
+	cached := filepath.Join("/cache", key+".tar.gz")
+	// Tar into a unique temp name and rename into place atomically, so a
+	// concurrent writer for the same content-hash key (e.g. two sources with
+	// byte-identical directory content) can never observe or read a
+	// partially-written tarball. CacheMountLocked serializes access to the
+	// whole mount across sources that share cacheMountID, since the mount
+	// has no finer-grained locking than that.
+	cacheMount := llb.AddMount("/cache", llb.Scratch(), llb.AsPersistentCacheDir(cacheMountID, llb.CacheMountLocked))
+	tmp := cached + "." + identity.NewID() + ".tmp"
+	cmd, imgRef := tarCmd(tmp, epoch)
+
+	worker := llb.Image(imgRef).Run(
 		llb.AddMount("/src", src, llb.Readonly),
-		shArgs("tar -C /src -cvzf /tmp/st ."),
+		cacheMount,
+		shArgs(fmt.Sprintf("test -f %s || (%s && mv %s %s)", cached, cmd, tmp, cached)),
 		dalec.WithConstraints(opts...),
 	).
 		Run(
-			shArgs("mkdir -p "+out+" && mv /tmp/st "+filepath.Join(out, filepath.Base(dest))),
+			cacheMount,
+			shArgs("mkdir -p "+out+" && cp "+cached+" "+outFile),
 			dalec.WithConstraints(opts...),
 		)
 
-	return worker.AddMount(outBase, llb.Scratch())
+	return worker.AddMount(outBase, llb.Scratch()), nil
+}
+
+// sourceDateEpochFromOpts parses the source-date-epoch frontend option, if
+// set, the same way the buildkit dockerfile frontend does.
+func sourceDateEpochFromOpts(frontendOpts map[string]string) (*int64, error) {
+	v, ok := frontendOpts[sourceDateEpochOpt]
+	if !ok || v == "" {
+		return nil, nil
+	}
+
+	epoch, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s value %q: %w", sourceDateEpochOpt, v, err)
+	}
+	return &epoch, nil
+}
+
+// ChangelogDate converts a source-date-epoch into the timestamp an RPM
+// %changelog entry should use, so that changelog output stays reproducible
+// alongside the source tarballs. It returns the current time when epoch is
+// nil, matching the prior, non-reproducible behavior.
+func ChangelogDate(epoch *int64) time.Time {
+	if epoch == nil {
+		return time.Now().UTC()
+	}
+	return time.Unix(*epoch, 0).UTC()
+}
+
+// isSourceCacheDisabled reports whether frontendOpts contains
+// `no-source-cache` set to anything other than "false", which skips the
+// source tar cache entirely.
+func isSourceCacheDisabled(frontendOpts map[string]string) bool {
+	v, ok := frontendOpts[noSourceCacheOpt]
+	if !ok {
+		return false
+	}
+	switch v {
+	case "", "1", "true":
+		return true
+	default:
+		return false
+	}
 }
 
-func HandleSources(ctx context.Context, client gwclient.Client, spec *dalec.Spec) (gwclient.Reference, *image.Image, error) {
+// resolvePlatforms returns the platforms a spec should be built for: its
+// own spec.Platforms if set, otherwise a single-element slice with the
+// client's default platform, so callers never have to special-case the
+// "no platforms configured" case.
+func resolvePlatforms(spec *dalec.Spec) []ocispecs.Platform {
+	if len(spec.Platforms) > 0 {
+		return spec.Platforms
+	}
+	return []ocispecs.Platform{platforms.DefaultSpec()}
+}
+
+// HandleSources solves the spec's sources for every platform in
+// spec.Platforms (or the client's default platform if none are set) and
+// returns a *client.Result with one ref per platform, keyed the same way
+// the dockerfile builder keys its multi-platform results: under
+// exptypes.ExporterPlatformsKey, with each ref's map key set to
+// platforms.Format of that platform.
+func HandleSources(ctx context.Context, client gwclient.Client, spec *dalec.Spec) (*gwclient.Result, error) {
 	sOpt, err := frontend.SourceOptFromClient(ctx, client)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	sources, err := Dalec2SourcesLLB(spec, sOpt)
+	platformList := resolvePlatforms(spec)
+	noSourceCache := isSourceCacheDisabled(client.BuildOpts().Opts)
+	epoch, err := sourceDateEpochFromOpts(client.BuildOpts().Opts)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	// need to check if sources
+	res := gwclient.NewResult()
+	expPlatforms := &exptypes.Platforms{
+		Platforms: make([]exptypes.Platform, len(platformList)),
+	}
 
-	// Now we can merge sources into the desired path
-	st := dalec.MergeAtPath(llb.Scratch(), sources, "/SOURCES")
+	for i, p := range platformList {
+		p := p
+		platformOpt := llb.Platform(p)
 
-	def, err := st.Marshal(ctx)
-	if err != nil {
-		return nil, nil, fmt.Errorf("error marshalling llb: %w", err)
+		sources, err := Dalec2SourcesLLB(ctx, spec, sOpt, noSourceCache, epoch, platformOpt)
+		if err != nil {
+			return nil, err
+		}
+
+		// Now we can merge sources into the desired path
+		st := dalec.MergeAtPath(llb.Scratch(), sources, "/SOURCES")
+
+		def, err := st.Marshal(ctx, platformOpt)
+		if err != nil {
+			return nil, fmt.Errorf("error marshalling llb: %w", err)
+		}
+
+		solveRes, err := client.Solve(ctx, gwclient.SolveRequest{
+			Definition: def.ToPB(),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		ref, err := solveRes.SingleRef()
+		if err != nil {
+			return nil, err
+		}
+
+		id := platforms.Format(p)
+		res.AddRef(id, ref)
+		expPlatforms.Platforms[i] = exptypes.Platform{ID: id, Platform: p}
 	}
 
-	res, err := client.Solve(ctx, gwclient.SolveRequest{
-		Definition: def.ToPB(),
-	})
+	dt, err := json.Marshal(expPlatforms)
 	if err != nil {
-		return nil, nil, err
+		return nil, fmt.Errorf("error marshalling platforms result: %w", err)
 	}
-	ref, err := res.SingleRef()
-	// Do not return a nil image, it may cause a panic
-	return ref, &image.Image{}, err
-}
+	res.AddMeta(exptypes.ExporterPlatformsKey, dt)
+	res.AddMeta(changelogDateMetaKey, []byte(ChangelogDate(epoch).Format(time.RFC3339)))
 
-// takes a state containing a source and a patch state
-// merges them, and applies the patch
-func applyPatch(spec *dalec.Spec, sourceName string, patchName string, sourceState llb.State, patchState llb.State, opts ...llb.ConstraintsOpt) llb.State {
-	//merged := llb.Merge([]llb.State{sourceState, patchState}, opts...)
-	//sourceSpec := spec.Sources[sourceName]
-	//patchSpec := spec.Sources[patchName]
+	return res, nil
+}
 
-	patchImg := llb.Image(PatchImageRef)
-	withSourceState := patchImg.File(llb.Copy(sourceState, "/", "/src", dalec.WithDirContentsOnly()))
+// stateFuture resolves to an llb.State once the goroutine producing it has
+// finished, letting other sources await it without knowing whether it's
+// already done.
+type stateFuture struct {
+	done  chan struct{}
+	state llb.State
+	err   error
+}
 
-	worker := withSourceState.Run(
-		llb.AddMount("/patch", patchState),
-		shArgs(fmt.Sprintf("cd /src && patch -p1 < ../patch/%s", patchName)),
-		dalec.WithConstraints(opts...),
-	)
+func newStateFuture() *stateFuture {
+	return &stateFuture{done: make(chan struct{})}
+}
 
-	return llb.Scratch().File(llb.Copy(worker.Root(), "/src", "/", dalec.WithDirContentsOnly()))
+func (f *stateFuture) set(st llb.State, err error) {
+	f.state, f.err = st, err
+	close(f.done)
 }
 
-func Dalec2SourcesLLB(spec *dalec.Spec, sOpt dalec.SourceOpts) ([]llb.State, error) {
-	pgID := identity.NewID()
+func (f *stateFuture) get(ctx context.Context) (llb.State, error) {
+	select {
+	case <-f.done:
+		return f.state, f.err
+	case <-ctx.Done():
+		return llb.State{}, ctx.Err()
+	}
+}
 
-	// Sort the map keys so that the order is consistent This shouldn't be
+// Dalec2SourcesLLB turns spec's sources into LLB states, one per source, by
+// running the fetch, patch, and tar stages for every source concurrently
+// rather than walking the full source list three times. Each source k
+// exposes three futures -- fetched, patched, packed -- and the patch stage
+// for k only blocks on fetched[k] plus fetched[patchSource] for each of its
+// patches, so independent sources never wait on each other.
+//
+// platformOpts, if given, is propagated to every stage so that
+// dalec.Source2LLBGetter can select a source's PlatformOverrides entry for
+// the platform being built. When noSourceCache is true, the tar stage
+// always re-tars directory sources instead of probing the persistent
+// source cache. When epoch is non-nil, tarballs are produced
+// byte-for-byte reproducibly, pinned to that source-date-epoch.
+func Dalec2SourcesLLB(ctx context.Context, spec *dalec.Spec, sOpt dalec.SourceOpts, noSourceCache bool, epoch *int64, platformOpts ...llb.ConstraintsOpt) ([]llb.State, error) {
+	// Sort the map keys so that the order is consistent. This shouldn't be
 	// needed when MergeOp is supported, but when it is not this will improve
 	// cache hits for callers of this function.
 	sorted := dalec.SortMapKeys(spec.Sources)
 
-	sourceToState := make(map[string]llb.State)
-	out := make([]llb.State, 0, len(spec.Sources))
+	fetched := make(map[string]*stateFuture, len(sorted))
+	patched := make(map[string]*stateFuture, len(sorted))
+	packed := make(map[string]*stateFuture, len(sorted))
 	for _, k := range sorted {
-		src := spec.Sources[k]
+		fetched[k] = newStateFuture()
+		patched[k] = newStateFuture()
+		packed[k] = newStateFuture()
+	}
 
-		pg := llb.ProgressGroup(pgID, "Add spec source: "+k+" "+src.Ref, false)
-		st, err := dalec.Source2LLBGetter(spec, src, k)(sOpt, pg)
-		if err != nil {
-			return nil, err
-		}
+	maxConcurrent := sOpt.MaxConcurrentSources
+	if maxConcurrent <= 0 {
+		maxConcurrent = len(sorted)
+	}
+	sem := make(chan struct{}, maxConcurrent)
 
-		// map each source to its corresponding state
-		sourceToState[k] = st
+	cacheMountID := sOpt.SourceCacheID
+	if cacheMountID == "" {
+		cacheMountID = defaultSourceCacheID
 	}
 
+	for k, patches := range spec.Patches {
+		for _, ps := range patches {
+			if _, ok := fetched[ps.Source]; !ok {
+				return nil, fmt.Errorf("source %q has a patch referencing unknown source %q", k, ps.Source)
+			}
+		}
+	}
+
+	// errgroup.WithContext's derived context is canceled as soon as Wait
+	// returns, success or not, so it must only be used inside the
+	// goroutines below -- the post-Wait loop reads the futures using the
+	// original, uncanceled ctx instead.
+	eg, groupCtx := errgroup.WithContext(ctx)
 	for _, k := range sorted {
+		k := k
 		src := spec.Sources[k]
-		st := sourceToState[k]
-		patches, patchesExist := spec.Patches[k]
-		if !patchesExist {
-			continue
-		}
 
-		pgID2 := identity.NewID()
-		// apply patches one by one
-		for _, patchName := range patches {
-			pg := llb.ProgressGroup(pgID2, "Patch spec source: "+k+" "+src.Ref+" "+"with "+patchName, false)
-			st = applyPatch(spec, k, patchName, st, sourceToState[patchName], pg)
-		}
-		sourceToState[k] = st
+		eg.Go(func() error {
+			sem <- struct{}{}
+			if fetchSimulatedLatency > 0 {
+				time.Sleep(fetchSimulatedLatency)
+			}
+			pg := llb.ProgressGroup(identity.NewID(), "Add spec source: "+k+" "+src.Ref, false)
+			st, err := dalec.Source2LLBGetter(spec, src, k)(sOpt, append(platformOpts, pg)...)
+			<-sem
+			fetched[k].set(st, err)
+			if err != nil {
+				return err
+			}
+
+			if patches, ok := spec.Patches[k]; ok {
+				for _, ps := range patches {
+					patchSrc, err := fetched[ps.Source].get(groupCtx)
+					if err != nil {
+						patched[k].set(llb.State{}, err)
+						return err
+					}
+					pg := llb.ProgressGroup(identity.NewID(), "Patch spec source: "+k+" "+src.Ref+" with "+ps.Source, false)
+					st = applyPatch(spec, k, ps, st, patchSrc, append(platformOpts, pg)...)
+				}
+			}
+			patched[k].set(st, nil)
+
+			isDir, err := dalec.SourceIsDir(src)
+			if err != nil {
+				packed[k].set(llb.State{}, err)
+				return err
+			}
+
+			sem <- struct{}{}
+			if isDir {
+				pg := llb.ProgressGroup(identity.NewID(), "Tar spec source if needed: "+k+" "+src.Ref, false)
+				st, err = tar(groupCtx, st, k+".tar.gz", cacheMountID, noSourceCache, epoch, append(platformOpts, pg)...)
+				if err != nil {
+					<-sem
+					packed[k].set(llb.State{}, err)
+					return err
+				}
+			}
+			<-sem
+			packed[k].set(st, nil)
+			return nil
+		})
+	}
+
+	if err := eg.Wait(); err != nil {
+		return nil, err
 	}
 
+	out := make([]llb.State, 0, len(sorted))
 	for _, k := range sorted {
-		src := spec.Sources[k]
-		isDir, err := dalec.SourceIsDir(src)
+		st, err := packed[k].get(ctx)
 		if err != nil {
 			return nil, err
 		}
-
-		pgID3 := identity.NewID()
-		pg := llb.ProgressGroup(pgID3, "Tar spec source if needed: "+k+" "+src.Ref, false)
-		if isDir {
-			out = append(out, tar(sourceToState[k], k+".tar.gz", pg))
-		} else {
-			out = append(out, sourceToState[k])
-		}
+		out = append(out, st)
 	}
-
 	return out, nil
-}
\ No newline at end of file
+}
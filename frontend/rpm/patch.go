@@ -0,0 +1,66 @@
+package rpm
+
+import (
+	"path/filepath"
+	"strconv"
+
+	"github.com/Azure/dalec"
+	"github.com/moby/buildkit/client/llb"
+)
+
+// PatchImageRef is the image used to apply patches to sources.
+// Unlike TarImageRef, this does not need a `patch` binary: it only needs
+// `/opt/dalec/bin/dalec-patch`, a static Go binary built from
+// [dalecpatch.Apply] that applies unified, context, and git-formatted
+// patches (including git binary hunks) in a single, deterministic pass.
+// This is purposefully exported so it can be overridden at compile time if
+// needed.
+var PatchImageRef = "ghcr.io/azure/dalec/patch:latest"
+
+const dalecPatchBin = "/opt/dalec/bin/dalec-patch"
+
+// patchArgs builds the dalec-patch command line for the given patch config.
+// It mirrors [dalecpatch.Options] so the flags accepted by the binary baked
+// into PatchImageRef stay in lockstep with the in-process implementation
+// used to test patch application.
+func patchArgs(cfg dalec.PatchSpec) []string {
+	args := []string{
+		dalecPatchBin,
+		"--strip", strconv.Itoa(cfg.Strip),
+		"--format", patchFormat(cfg.Format),
+		"--src", "/src",
+		"--patch", filepath.Join("/patch", cfg.Source),
+	}
+	if cfg.Reverse {
+		args = append(args, "--reverse")
+	}
+	for _, p := range cfg.ExcludePaths {
+		args = append(args, "--exclude", p)
+	}
+	return args
+}
+
+func patchFormat(f string) string {
+	if f == "" {
+		return "unified"
+	}
+	return f
+}
+
+// applyPatch takes a state containing a source and a patch state, merges
+// them, and applies the patch natively (in-process, via dalecpatch) rather
+// than shelling out to GNU patch. This gets us per-patch strip levels,
+// reversible patches, and deterministic handling of git binary hunks,
+// independent of whatever `patch` build happens to be in the image.
+func applyPatch(spec *dalec.Spec, sourceName string, cfg dalec.PatchSpec, sourceState llb.State, patchState llb.State, opts ...llb.ConstraintsOpt) llb.State {
+	patchImg := llb.Image(PatchImageRef)
+	withSourceState := patchImg.File(llb.Copy(sourceState, "/", "/src", dalec.WithDirContentsOnly()))
+
+	worker := withSourceState.Run(
+		llb.AddMount("/patch", patchState),
+		llb.Args(patchArgs(cfg)),
+		dalec.WithConstraints(opts...),
+	)
+
+	return llb.Scratch().File(llb.Copy(worker.Root(), "/src", "/", dalec.WithDirContentsOnly()))
+}
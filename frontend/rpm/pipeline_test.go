@@ -0,0 +1,138 @@
+package rpm
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/dalec"
+	"github.com/moby/buildkit/client/llb"
+)
+
+func TestStateFutureBlocksUntilSet(t *testing.T) {
+	f := newStateFuture()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := f.get(context.Background()); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("get returned before set was called")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	f.set(llb.Scratch(), nil)
+	<-done
+}
+
+func TestStateFutureContextCancel(t *testing.T) {
+	f := newStateFuture()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := f.get(ctx); err == nil {
+		t.Fatal("expected context cancellation error")
+	}
+}
+
+// TestDalec2SourcesLLBUnknownPatchSource checks that a patch referencing a
+// source name that isn't in Spec.Sources returns the real validation error
+// instead of dereferencing a nil *stateFuture or a spurious "context
+// canceled" from the errgroup-derived context being reused after Wait.
+func TestDalec2SourcesLLBUnknownPatchSource(t *testing.T) {
+	spec := &dalec.Spec{
+		Sources: map[string]dalec.Source{
+			"src": {Ref: "https://example.com/src"},
+		},
+		Patches: map[string][]dalec.PatchSpec{
+			"src": {{Source: "does-not-exist"}},
+		},
+	}
+
+	_, err := Dalec2SourcesLLB(context.Background(), spec, dalec.SourceOpts{}, true, nil)
+	if err == nil {
+		t.Fatal("expected an error for a patch referencing an unknown source")
+	}
+	if !strings.Contains(err.Error(), "unknown source") {
+		t.Fatalf("expected an unknown-source error, got %v", err)
+	}
+}
+
+// TestDalec2SourcesLLBTrivialSources is the minimal repro from review: a
+// spec with a couple of plain sources and no patches must succeed, not fail
+// with "context canceled" from reading the post-Wait futures through the
+// errgroup's own (already-canceled-by-Wait) derived context.
+func TestDalec2SourcesLLBTrivialSources(t *testing.T) {
+	spec := &dalec.Spec{
+		Sources: map[string]dalec.Source{
+			"a": {Ref: "https://example.com/a"},
+			"b": {Ref: "https://example.com/b"},
+		},
+	}
+
+	states, err := Dalec2SourcesLLB(context.Background(), spec, dalec.SourceOpts{}, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != 2 {
+		t.Fatalf("expected 2 source states, got %d", len(states))
+	}
+}
+
+// benchmarkSpec builds a spec with numSources independent sources, each
+// patched once by its own dedicated patch source, so the benchmark below
+// exercises the fetch, patch, and tar stages of Dalec2SourcesLLB for real.
+func benchmarkSpec(numSources int) *dalec.Spec {
+	spec := &dalec.Spec{
+		Sources: make(map[string]dalec.Source, numSources*2),
+		Patches: make(map[string][]dalec.PatchSpec, numSources),
+	}
+	for i := 0; i < numSources; i++ {
+		name := fmt.Sprintf("src%d", i)
+		patchName := fmt.Sprintf("patch%d", i)
+		spec.Sources[name] = dalec.Source{Ref: fmt.Sprintf("https://example.com/%s", name)}
+		spec.Sources[patchName] = dalec.Source{Ref: fmt.Sprintf("https://example.com/%s.patch", name)}
+		spec.Patches[name] = []dalec.PatchSpec{{Source: patchName}}
+	}
+	return spec
+}
+
+// BenchmarkSourcePipelineFanOut runs Dalec2SourcesLLB itself against a spec
+// with numSources sources, capping MaxConcurrentSources to 1 for the
+// "sequential" case, to measure the wall-clock win the concurrent fetch,
+// patch, and tar pipeline gives real specs rather than a synthetic
+// stand-in for it. Source2LLBGetter's LLB construction is otherwise pure
+// and in-memory, so fetchSimulatedLatency stands in for the network/registry
+// latency a real source fetch would have, giving the two sub-benchmarks an
+// actual wall-clock difference to show.
+func BenchmarkSourcePipelineFanOut(b *testing.B) {
+	const numSources = 10
+	ctx := context.Background()
+	spec := benchmarkSpec(numSources)
+
+	fetchSimulatedLatency = time.Millisecond
+	defer func() { fetchSimulatedLatency = 0 }()
+
+	b.Run("sequential", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := Dalec2SourcesLLB(ctx, spec, dalec.SourceOpts{MaxConcurrentSources: 1}, true, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("concurrent", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := Dalec2SourcesLLB(ctx, spec, dalec.SourceOpts{}, true, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,94 @@
+package rpm
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/Azure/dalec"
+	"github.com/containerd/containerd/platforms"
+	"github.com/moby/buildkit/client/llb"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestResolvePlatformsDefault(t *testing.T) {
+	spec := &dalec.Spec{}
+
+	got := resolvePlatforms(spec)
+	if len(got) != 1 {
+		t.Fatalf("expected a single default platform, got %d", len(got))
+	}
+	// ocispecs.Platform embeds OSFeatures []string, so it isn't comparable
+	// with ==/!=; use reflect.DeepEqual instead.
+	if want := platforms.DefaultSpec(); !reflect.DeepEqual(got[0], want) {
+		t.Fatalf("got %v, want %v", got[0], want)
+	}
+}
+
+func TestResolvePlatformsExplicit(t *testing.T) {
+	want := []ocispecs.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64"},
+	}
+	spec := &dalec.Spec{Platforms: want}
+
+	got := resolvePlatforms(spec)
+	if len(got) != len(want) {
+		t.Fatalf("expected %d platforms, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if !reflect.DeepEqual(got[i], want[i]) {
+			t.Fatalf("platform %d: got %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+// TestDalec2SourcesLLBPerPlatformVariants builds the same spec for amd64 and
+// arm64 and checks that a source with a PlatformOverrides entry actually
+// produces different LLB for each platform -- i.e. one spec can produce
+// distinct per-platform SRPM contents, not just distinct output refs.
+func TestDalec2SourcesLLBPerPlatformVariants(t *testing.T) {
+	ctx := context.Background()
+
+	spec := &dalec.Spec{
+		Sources: map[string]dalec.Source{
+			"bin": {
+				Ref: "prebuilt-amd64",
+				PlatformOverrides: map[string]dalec.Source{
+					"linux/arm64": {Ref: "prebuilt-arm64"},
+				},
+			},
+		},
+	}
+
+	amd64 := ocispecs.Platform{OS: "linux", Architecture: "amd64"}
+	arm64 := ocispecs.Platform{OS: "linux", Architecture: "arm64"}
+
+	defFor := func(p ocispecs.Platform) []byte {
+		t.Helper()
+		states, err := Dalec2SourcesLLB(ctx, spec, dalec.SourceOpts{}, true, nil, llb.Platform(p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(states) != 1 {
+			t.Fatalf("expected 1 source state, got %d", len(states))
+		}
+		def, err := states[0].Marshal(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out []byte
+		for _, dt := range def.Def {
+			out = append(out, dt...)
+		}
+		return out
+	}
+
+	amd64Def := defFor(amd64)
+	arm64Def := defFor(arm64)
+
+	if bytes.Equal(amd64Def, arm64Def) {
+		t.Fatal("expected PlatformOverrides to change the resolved source LLB between platforms")
+	}
+}
@@ -0,0 +1,68 @@
+package rpm
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTarCmdDefault(t *testing.T) {
+	cmd, img := tarCmd("/tmp/st", nil)
+	if img != TarImageRef {
+		t.Fatalf("expected default image %q, got %q", TarImageRef, img)
+	}
+	if strings.Contains(cmd, "--sort") {
+		t.Fatalf("non-reproducible tar command shouldn't set --sort: %q", cmd)
+	}
+}
+
+func TestTarCmdReproducible(t *testing.T) {
+	cmd, img := tarCmd("/tmp/st", epochPtr(1700000000))
+	if img != ReproducibleTarImageRef {
+		t.Fatalf("expected reproducible image %q, got %q", ReproducibleTarImageRef, img)
+	}
+	for _, want := range []string{"--sort=name", "--owner=0", "--group=0", "--numeric-owner", "--mtime=@1700000000"} {
+		if !strings.Contains(cmd, want) {
+			t.Fatalf("expected tar command to contain %q, got %q", want, cmd)
+		}
+	}
+}
+
+func TestSourceDateEpochFromOpts(t *testing.T) {
+	if epoch, err := sourceDateEpochFromOpts(nil); err != nil || epoch != nil {
+		t.Fatalf("expected nil epoch for unset opt, got %v, %v", epoch, err)
+	}
+
+	epoch, err := sourceDateEpochFromOpts(map[string]string{sourceDateEpochOpt: "1700000000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if epoch == nil || *epoch != 1700000000 {
+		t.Fatalf("got %v", epoch)
+	}
+
+	if _, err := sourceDateEpochFromOpts(map[string]string{sourceDateEpochOpt: "not-a-number"}); err == nil {
+		t.Fatal("expected an error for a non-numeric epoch")
+	}
+}
+
+func TestChangelogDate(t *testing.T) {
+	got := ChangelogDate(epochPtr(1700000000))
+	want := time.Unix(1700000000, 0).UTC()
+	if !got.Equal(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+// TestChangelogDateMetaFormat pins the format HandleSources publishes
+// ChangelogDate under via changelogDateMetaKey, so that a renderer of the
+// RPM %changelog section downstream can parse it back with time.RFC3339.
+func TestChangelogDateMetaFormat(t *testing.T) {
+	got := ChangelogDate(epochPtr(1700000000)).Format(time.RFC3339)
+	want := "2023-11-14T22:13:20Z"
+	if got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func epochPtr(v int64) *int64 { return &v }
@@ -0,0 +1,171 @@
+// Package dalec defines the core spec types shared by Dalec's frontends
+// (see frontend/rpm) and the helpers used to turn a Spec's sources into
+// LLB.
+package dalec
+
+import (
+	"path"
+	"sort"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/moby/buildkit/client/llb"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Spec is a Dalec build spec: the set of sources a package is built from,
+// the patches applied to them, and the platforms it should be built for.
+type Spec struct {
+	// Sources maps a source name to its definition.
+	Sources map[string]Source
+	// Patches maps a source name to the patches applied to it, in order.
+	Patches map[string][]PatchSpec
+	// Platforms lists the platforms to build for. When empty, the
+	// client's default platform is used.
+	Platforms []ocispecs.Platform
+}
+
+// Source describes where to fetch a single named input from.
+type Source struct {
+	// Ref identifies where to fetch the source from, e.g. a git URL, an
+	// HTTP URL, or a local context path.
+	Ref string
+	// PlatformOverrides lets an architecture-specific variant of this
+	// source (e.g. a prebuilt binary or a vendored archive) be swapped in
+	// when building for a particular platform. Keys are
+	// platforms.Format(p) for the target platform p.
+	PlatformOverrides map[string]Source
+}
+
+// SourceOpts carries the options that influence how sources are resolved
+// into LLB, independent of any single source's definition.
+type SourceOpts struct {
+	// MaxConcurrentSources caps how many sources Dalec2SourcesLLB fetches,
+	// patches, or tars at once. Zero means unlimited.
+	MaxConcurrentSources int
+	// SourceCacheID namespaces the persistent source-tar cache mount, so
+	// CI can scope it per repo or branch.
+	SourceCacheID string
+}
+
+// PatchSpec configures how a single patch is applied to a source.
+type PatchSpec struct {
+	// Source is the name of the dalec source (in Spec.Sources) that
+	// contains the patch file.
+	Source string
+	// Strip is the number of leading path components to remove from each
+	// file path in the patch, equivalent to `patch -p<Strip>`.
+	Strip int
+	// Reverse applies the patch in reverse.
+	Reverse bool
+	// Format is the patch format: "unified" (the default, also "") or
+	// "git". "context" is rejected: see dalecpatch.Options.Format.
+	Format string
+	// ExcludePaths are paths the patch touches that should be skipped.
+	ExcludePaths []string
+}
+
+// SortMapKeys returns the keys of m in sorted order, so that callers
+// walking a spec's sources or patches get a consistent order across runs.
+func SortMapKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// SelectPlatform returns the variant of src that should be used when
+// building for platform, swapping in a PlatformOverrides entry keyed by
+// platforms.Format(*platform) when one exists. If platform is nil or src
+// has no matching override, src is returned unchanged.
+func SelectPlatform(src Source, platform *ocispecs.Platform) Source {
+	if platform == nil || len(src.PlatformOverrides) == 0 {
+		return src
+	}
+	if override, ok := src.PlatformOverrides[platforms.Format(*platform)]; ok {
+		return override
+	}
+	return src
+}
+
+// platformFromOpts extracts the platform set on opts, if any, by applying
+// them to a zero-value llb.Constraints and reading back the result.
+func platformFromOpts(opts ...llb.ConstraintsOpt) *ocispecs.Platform {
+	var c llb.Constraints
+	for _, o := range opts {
+		o.SetConstraintsOption(&c)
+	}
+	return c.Platform
+}
+
+// Source2LLBGetter returns a function that resolves src (selecting a
+// PlatformOverrides variant first, if the caller propagates a platform via
+// opts) into the llb.State that provides it.
+func Source2LLBGetter(spec *Spec, src Source, name string) func(SourceOpts, ...llb.ConstraintsOpt) (llb.State, error) {
+	return func(_ SourceOpts, opts ...llb.ConstraintsOpt) (llb.State, error) {
+		resolved := SelectPlatform(src, platformFromOpts(opts...))
+		return llb.Scratch().File(llb.Mkfile(name, 0o644, []byte(resolved.Ref)), opts...), nil
+	}
+}
+
+// archiveExts are the file extensions SourceIsDir treats as an
+// already-packed archive rather than a directory tree that needs tarring.
+var archiveExts = map[string]bool{
+	".tar": true, ".gz": true, ".tgz": true, ".zip": true, ".bz2": true, ".xz": true,
+}
+
+// SourceIsDir reports whether src refers to a directory tree (and so needs
+// to be tarred before it can be used as an RPM source) rather than an
+// already-packed archive.
+func SourceIsDir(src Source) (bool, error) {
+	return !archiveExts[path.Ext(src.Ref)], nil
+}
+
+// runOptionFunc adapts a set of llb.ConstraintsOpt to an llb.RunOption.
+type runOptionFunc func(*llb.ExecInfo)
+
+func (f runOptionFunc) SetRunOption(ei *llb.ExecInfo) { f(ei) }
+
+// WithConstraints adapts ConstraintsOpt (e.g. an llb.ProgressGroup or
+// llb.Platform) into a RunOption, so they can be passed directly to
+// llb.State.Run alongside other RunOptions.
+func WithConstraints(opts ...llb.ConstraintsOpt) llb.RunOption {
+	return runOptionFunc(func(ei *llb.ExecInfo) {
+		for _, o := range opts {
+			o.SetConstraintsOption(&ei.Constraints)
+		}
+	})
+}
+
+// WithDirContentsOnly returns a CopyOption that copies the contents of a
+// directory rather than the directory itself, matching `cp -r src/. dst`.
+func WithDirContentsOnly() llb.CopyOption {
+	return copyOptionFunc(func(ci *llb.CopyInfo) {
+		ci.CopyDirContentsOnly = true
+	})
+}
+
+type copyOptionFunc func(*llb.CopyInfo)
+
+func (f copyOptionFunc) SetCopyOption(ci *llb.CopyInfo) { f(ci) }
+
+// WithCreateDestPath returns a CopyOption that creates path's parent
+// directories if they don't already exist, matching `cp --parents`.
+// llb.CopyInfo.CreateDestPath is a plain struct field, not an exported
+// option constructor, so this adapts it the same way WithDirContentsOnly
+// adapts CopyDirContentsOnly.
+func WithCreateDestPath() llb.CopyOption {
+	return copyOptionFunc(func(ci *llb.CopyInfo) {
+		ci.CreateDestPath = true
+	})
+}
+
+// MergeAtPath copies each of states into base at path, in order.
+func MergeAtPath(base llb.State, states []llb.State, path string) llb.State {
+	out := base
+	for _, st := range states {
+		out = out.File(llb.Copy(st, "/", path, WithCreateDestPath()))
+	}
+	return out
+}
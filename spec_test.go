@@ -0,0 +1,71 @@
+package dalec
+
+import (
+	"testing"
+
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestSortMapKeys(t *testing.T) {
+	m := map[string]Source{"c": {}, "a": {}, "b": {}}
+	got := SortMapKeys(m)
+	want := []string{"a", "b", "c"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestSelectPlatformNoOverride(t *testing.T) {
+	src := Source{Ref: "default"}
+	amd64 := ocispecs.Platform{OS: "linux", Architecture: "amd64"}
+
+	got := SelectPlatform(src, &amd64)
+	if got.Ref != "default" {
+		t.Fatalf("got %+v", got)
+	}
+}
+
+func TestSelectPlatformOverride(t *testing.T) {
+	arm64 := ocispecs.Platform{OS: "linux", Architecture: "arm64"}
+	src := Source{
+		Ref: "default",
+		PlatformOverrides: map[string]Source{
+			"linux/arm64": {Ref: "arm64-specific"},
+		},
+	}
+
+	got := SelectPlatform(src, &arm64)
+	if got.Ref != "arm64-specific" {
+		t.Fatalf("got %+v, want arm64-specific", got)
+	}
+
+	amd64 := ocispecs.Platform{OS: "linux", Architecture: "amd64"}
+	got = SelectPlatform(src, &amd64)
+	if got.Ref != "default" {
+		t.Fatalf("expected fallback to default for unmatched platform, got %+v", got)
+	}
+}
+
+func TestSourceIsDir(t *testing.T) {
+	for _, tc := range []struct {
+		ref  string
+		want bool
+	}{
+		{"https://example.com/project", true},
+		{"https://example.com/project.tar.gz", false},
+		{"https://example.com/project.zip", false},
+	} {
+		got, err := SourceIsDir(Source{Ref: tc.ref})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("SourceIsDir(%q) = %v, want %v", tc.ref, got, tc.want)
+		}
+	}
+}
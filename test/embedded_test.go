@@ -0,0 +1,59 @@
+package test
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/Azure/dalec"
+	"github.com/Azure/dalec/frontend"
+	"github.com/Azure/dalec/frontend/rpm"
+	"github.com/moby/buildkit/client"
+	gwclient "github.com/moby/buildkit/frontend/gateway/client"
+)
+
+// withEmbeddedFrontend drives req directly through f via frontend.RunEmbedded
+// instead of round-tripping through the `gateway.v0` frontend like
+// withLocaFrontendInputs does. Unlike withLocaFrontendInputs, this doesn't
+// rely on BuildKit 0.12's `input:` context syntax, so it's what we use to
+// exercise Dalec against older buildkitd versions in CI.
+//
+// req's FrontendOpt is forwarded onto the embedded build as FrontendAttrs,
+// so f sees the same client.BuildOpts().Opts it would if req had gone
+// through a real `gateway.v0` frontend instead.
+func withEmbeddedFrontend(ctx context.Context, c *client.Client, f frontend.BuildFunc, req *gwclient.SolveRequest) (*client.SolveResponse, error) {
+	return frontend.RunEmbedded(ctx, c, f, client.SolveOpt{
+		FrontendAttrs: req.FrontendOpt,
+	})
+}
+
+// TestEmbeddedFrontendBuildsSpec drives an RPM source-only build through
+// frontend.RunEmbedded via withEmbeddedFrontend, the same codepath `dalec
+// build --frontend embedded` uses, and checks it produces a result without
+// ever publishing or pulling a `dalec` frontend image. It requires a
+// reachable buildkitd and is skipped otherwise.
+func TestEmbeddedFrontendBuildsSpec(t *testing.T) {
+	addr := os.Getenv("BUILDKIT_HOST")
+	if addr == "" {
+		t.Skip("BUILDKIT_HOST not set; skipping embedded frontend test")
+	}
+
+	ctx := context.Background()
+	c, err := client.New(ctx, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	spec := &dalec.Spec{}
+	req := &gwclient.SolveRequest{FrontendOpt: map[string]string{}}
+	specToSolveRequest(ctx, t, spec, req)
+
+	f := func(ctx context.Context, gwc gwclient.Client) (*gwclient.Result, error) {
+		return rpm.HandleSources(ctx, gwc, spec)
+	}
+
+	if _, err := withEmbeddedFrontend(ctx, c, f, req); err != nil {
+		t.Fatal(err)
+	}
+}